@@ -25,15 +25,40 @@
 //
 // This Lexer is meant to emit tokens in such a fashion that it can be consumed
 // by go yacc.
+//
+// Tokens used to be produced by a background goroutine feeding a channel.
+// As of this version the Lexer is pull-based instead, following Rob Pike's
+// later rewrite of text/template/parse (~45% faster): NextToken drives the
+// current StateFunc itself, only as far as is needed to produce the next
+// token, and nothing runs ahead of the caller. Start and StartSync remain
+// only as compatibility shims for code that still calls them before looping
+// over NextToken; they simply run the Lexer to completion up front.
+//
+// A StateFunc may call Emit more than once before returning; every emitted
+// Token is queued and handed out in order by NextToken. If you'd rather
+// adapt an existing StateFunc one Emit at a time instead of restructuring it,
+// EmitState wraps a single Emit call in its own StateFunc so the function
+// pauses there and hands control back, resuming at the following StateFunc
+// on the next call to NextToken.
 package lexer
 
 import (
+	"bufio"
+	"bytes"
+	"io"
 	"strings"
 	"unicode/utf8"
 
 	"github.com/nochso/ctxerr"
 )
 
+// maxSeenBytes bounds how much of the consumed source l.seen retains for
+// Error's context, so lexing a large file or long-lived stream doesn't keep
+// the whole thing resident in memory. The bound holds only at line breaks:
+// while a line longer than maxSeenBytes is being read, l.seen grows past it
+// (see trimSeen).
+const maxSeenBytes = 64 * 1024
+
 // StateFunc returns the next logical StateFunc or nil on end.
 type StateFunc func(*L) StateFunc
 
@@ -45,77 +70,148 @@ const (
 	EOFRune rune = -1
 )
 
-// Token with the type and value as emitted when lexing.
+const (
+	// TokenEOF is emitted once after the last Token a StateFunc produces,
+	// letting callers detect end of input from within NextToken's own
+	// switch instead of relying on its second return value.
+	TokenEOF TokenType = -(iota + 1)
+	// TokenError is emitted whenever Error is called, carrying the error's
+	// message as its Value.
+	TokenError
+)
+
+// Token with the type and value as emitted when lexing. Line and Col are the
+// position of the first rune of Value; StartOffset and EndOffset are the
+// corresponding byte offsets into the source.
 type Token struct {
-	Type  TokenType
-	Value string
+	Type        TokenType
+	Value       string
+	Line        int
+	Col         int
+	StartOffset int
+	EndOffset   int
+}
+
+// pendingRune is a rune rewound by Rewind, queued to be replayed by the next
+// call to Next before the underlying reader is read again.
+type pendingRune struct {
+	r    rune
+	size int
 }
 
 // L is a generic lexer.
 type L struct {
-	source          string
-	start, position int
-	startState      StateFunc
-	Err             error
-	tokens          chan Token
-	ErrorHandler    func(error)
-	rewind          runeStack
-	line, col       int
+	reader        *bufio.Reader
+	pending       []pendingRune // runes un-read via Rewind, replayed before reader is read again
+	seen          []byte        // trailing window of source read from reader so far, for Error's context
+	seenStartLine int           // line number of the first line still held in seen
+	tokenBuf      []rune        // runes consumed since the last Emit/Ignore
+	offset        int           // byte offset of the next rune to be read
+	tokenStart    int           // byte offset where the currently analyzed token began
+	state         StateFunc
+	stateStack    []StateFunc
+	Err           error
+	items         []Token
+	eofEmitted    bool
+	ioErrReported bool // whether a non-io.EOF reader error has already been surfaced via Error
+	ErrorHandler  func(error)
+	rewind        runeStack
+	line, col     int
 }
 
 // New creates a returns a lexer ready to parse the given source code.
 func New(src string, start StateFunc) *L {
+	return NewReader(strings.NewReader(src), start)
+}
+
+// NewReader creates a lexer that reads its source lazily from r, one rune at
+// a time, instead of requiring it all in memory up front. This is suitable
+// for lexing large files or streamed input.
+func NewReader(r io.Reader, start StateFunc) *L {
 	return &L{
-		source:     src,
-		startState: start,
-		start:      0,
-		position:   0,
-		rewind:     newRuneStack(),
-		line:       1,
-		col:        1,
+		reader:        bufio.NewReader(r),
+		state:         start,
+		rewind:        newRuneStack(),
+		line:          1,
+		col:           1,
+		seenStartLine: 1,
 	}
 }
 
-// Start begins executing the Lexer in an asynchronous manner (using a goroutine).
+// Start runs the Lexer to completion up front, queueing every Token it
+// produces.
+//
+// Deprecated: NextToken now drives the Lexer lazily on its own, so calling
+// Start is no longer required. It's kept for code written against the old
+// asynchronous API.
 func (l *L) Start() {
-	// Take half the string length as a buffer size.
-	buffSize := len(l.source) / 2
-	if buffSize <= 0 {
-		buffSize = 1
-	}
-	l.tokens = make(chan Token, buffSize)
-	go l.run()
+	l.run()
 }
 
 // StartSync lexes all Tokens synchronously and then returns.
+//
+// Deprecated: see Start.
 func (l *L) StartSync() {
-	// Take half the string length as a buffer size.
-	buffSize := len(l.source) / 2
-	if buffSize <= 0 {
-		buffSize = 1
-	}
-	l.tokens = make(chan Token, buffSize)
 	l.run()
 }
 
 // Current returns the value being being analyzed at this moment.
 func (l *L) Current() string {
-	return l.source[l.start:l.position]
+	return string(l.tokenBuf)
 }
 
-// Emit will receive a token type and push a new token with the current analyzed
-// value into the tokens channel.
+// Emit will receive a token type and queue a new token with the current
+// analyzed value to be returned by NextToken.
 func (l *L) Emit(t TokenType) {
+	startLine, startCol := l.line, l.col
+	startOffset := l.tokenStart
 	l.line, l.col = trackPos(l.Current(), l.line, l.col)
 	tok := Token{
-		Type:  t,
-		Value: l.Current(),
+		Type:        t,
+		Value:       l.Current(),
+		Line:        startLine,
+		Col:         startCol,
+		StartOffset: startOffset,
+		EndOffset:   l.offset,
 	}
-	l.tokens <- tok
-	l.start = l.position
+	l.items = append(l.items, tok)
+	l.tokenBuf = l.tokenBuf[:0]
+	l.tokenStart = l.offset
 	l.rewind.clear()
 }
 
+// EmitState returns a StateFunc that emits t and then hands control back to
+// the caller, resuming at next on the following call to NextToken.
+//
+// This lets a StateFunc that used to call Emit and keep running be adapted
+// incrementally: return lexer.EmitState(t, next) wherever it should instead
+// pause after emitting a single token.
+func EmitState(t TokenType, next StateFunc) StateFunc {
+	return func(l *L) StateFunc {
+		l.Emit(t)
+		return next
+	}
+}
+
+// PushState pushes a StateFunc onto an internal stack, so a nested grammar
+// can later return to it via PopState instead of hard-coding where it
+// resumes.
+func (l *L) PushState(s StateFunc) {
+	l.stateStack = append(l.stateStack, s)
+}
+
+// PopState pops and returns the most recently pushed StateFunc, or nil if
+// the stack is empty.
+func (l *L) PopState() StateFunc {
+	n := len(l.stateStack)
+	if n == 0 {
+		return nil
+	}
+	s := l.stateStack[n-1]
+	l.stateStack = l.stateStack[:n-1]
+	return s
+}
+
 func trackPos(s string, line, col int) (int, int) {
 	newLines := strings.Count(s, "\n")
 	line += newLines
@@ -129,12 +225,13 @@ func trackPos(s string, line, col int) (int, int) {
 	return line, col
 }
 
-// Ignore clears the rewind stack and then sets the current beginning position
-// to the current position in the source which effectively ignores the section
-// of the source being analyzed.
+// Ignore clears the rewind stack and then drops the currently analyzed value,
+// effectively ignoring the section of the source read so far.
 func (l *L) Ignore() {
 	l.rewind.clear()
-	l.start = l.position
+	l.line, l.col = trackPos(l.Current(), l.line, l.col)
+	l.tokenBuf = l.tokenBuf[:0]
+	l.tokenStart = l.offset
 }
 
 // Peek performs a Next operation immediately followed by a Rewind returning the
@@ -150,12 +247,12 @@ func (l *L) Peek() rune {
 // occur more than once per call to Next but you can never rewind past the
 // last point a token was emitted.
 func (l *L) Rewind() {
-	r := l.rewind.pop()
+	r, size := l.rewind.pop()
 	if r > EOFRune {
-		size := utf8.RuneLen(r)
-		l.position -= size
-		if l.position < l.start {
-			l.position = l.start
+		l.pending = append(l.pending, pendingRune{r: r, size: size})
+		l.offset -= size
+		if n := len(l.tokenBuf); n > 0 {
+			l.tokenBuf = l.tokenBuf[:n-1]
 		}
 	}
 }
@@ -163,22 +260,98 @@ func (l *L) Rewind() {
 // Next pulls the next rune from the Lexer and returns it, moving the position
 // forward in the source.
 func (l *L) Next() rune {
-	var (
-		r rune
-		s int
-	)
-	str := l.source[l.position:]
-	if len(str) == 0 {
-		r, s = EOFRune, 0
+	var r rune
+	var size int
+	if n := len(l.pending); n > 0 {
+		p := l.pending[n-1]
+		l.pending = l.pending[:n-1]
+		r, size = p.r, p.size
 	} else {
-		r, s = utf8.DecodeRuneInString(str)
+		// Peek instead of ReadRune so that, on invalid UTF-8, size reflects
+		// the actual number of bytes consumed (1) and l.seen keeps the real
+		// source bytes, rather than re-deriving both from the decoded
+		// replacement rune via utf8.RuneLen/EncodeRune.
+		buf, err := l.reader.Peek(utf8.UTFMax)
+		if len(buf) == 0 {
+			if err != nil && err != io.EOF && !l.ioErrReported {
+				l.ioErrReported = true
+				l.Error(err)
+			}
+			r, size = EOFRune, 0
+		} else {
+			r, size = utf8.DecodeRune(buf)
+			l.reader.Discard(size)
+			l.seen = append(l.seen, buf[:size]...)
+			l.trimSeen()
+		}
+	}
+	l.rewind.push(r, size)
+	if r != EOFRune {
+		l.tokenBuf = append(l.tokenBuf, r)
+		l.offset += size
 	}
-	l.position += s
-	l.rewind.push(r)
 
 	return r
 }
 
+// Accept consumes the next rune if it is one of valid, reporting whether it
+// did.
+func (l *L) Accept(valid string) bool {
+	if strings.ContainsRune(valid, l.Next()) {
+		return true
+	}
+	l.Rewind()
+	return false
+}
+
+// AcceptRun consumes runes as long as they're one of valid, returning how
+// many were consumed. Unlike Take it reports the count instead of discarding
+// it.
+func (l *L) AcceptRun(valid string) int {
+	n := 0
+	for strings.ContainsRune(valid, l.Next()) {
+		n++
+	}
+	l.Rewind() // last next wasn't a match
+	return n
+}
+
+// AcceptString consumes s in full if the upcoming runes match it exactly,
+// rewinding back to where it started otherwise.
+func (l *L) AcceptString(s string) bool {
+	consumed := 0
+	for _, want := range s {
+		r := l.Next()
+		consumed++
+		if r != want {
+			for i := 0; i < consumed; i++ {
+				l.Rewind()
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// PeekN looks ahead up to n runes without consuming any of them. Fewer than
+// n runes are returned if EOF is reached first.
+func (l *L) PeekN(n int) []rune {
+	runes := make([]rune, 0, n)
+	calls := 0
+	for i := 0; i < n; i++ {
+		r := l.Next()
+		calls++
+		if r == EOFRune {
+			break
+		}
+		runes = append(runes, r)
+	}
+	for i := 0; i < calls; i++ {
+		l.Rewind()
+	}
+	return runes
+}
+
 // Take receives a string containing all acceptable strings and will contine
 // over each consecutive character in the source until a token not in the given
 // string is encountered. This should be used to quickly pull token parts.
@@ -192,18 +365,47 @@ func (l *L) Take(chars string) {
 
 // NextToken returns the next token from the lexer and a value to denote whether
 // or not the token is finished.
+//
+// Tokens are produced on demand: if none are queued yet, the current
+// StateFunc is driven forward just far enough to emit one (or run out). Once
+// the Lexer is out of input, NextToken returns a single TokenEOF before
+// finally reporting done.
 func (l *L) NextToken() (*Token, bool) {
-	if tok, ok := <-l.tokens; ok {
-		return &tok, false
+	for len(l.items) == 0 && l.state != nil {
+		l.state = l.state(l)
 	}
-	return nil, true
+	if len(l.items) == 0 {
+		l.emitEOF()
+	}
+	if len(l.items) == 0 {
+		return nil, true
+	}
+	tok := l.items[0]
+	l.items = l.items[1:]
+	return &tok, false
 }
 
+// Error records e as the Lexer's error and, besides the existing Err/
+// ErrorHandler reporting, queues a TokenError carrying e's message so
+// NextToken's caller can handle it like any other Token.
 func (l *L) Error(e error) {
 	endLine, endCol := trackPos(l.Current(), l.line, l.col)
-	err := ctxerr.New(l.source, ctxerr.Range(l.line, l.col, endLine, endCol-1))
+	// l.seen only retains a trailing window of the source, so line numbers
+	// passed to ctxerr.Range must be relative to l.seenStartLine rather than
+	// the absolute line numbers tracked on l.
+	startLine := l.line - l.seenStartLine + 1
+	relEndLine := endLine - l.seenStartLine + 1
+	err := ctxerr.New(string(l.seen), ctxerr.Range(startLine, l.col, relEndLine, endCol-1))
 	err.Err = e
 	l.Err = err
+	l.items = append(l.items, Token{
+		Type:        TokenError,
+		Value:       e.Error(),
+		Line:        l.line,
+		Col:         l.col,
+		StartOffset: l.tokenStart,
+		EndOffset:   l.offset,
+	})
 	if l.ErrorHandler != nil {
 		l.ErrorHandler(l.Err)
 	}
@@ -211,10 +413,44 @@ func (l *L) Error(e error) {
 
 // Private methods
 
+// trimSeen drops whole leading lines from l.seen once it grows past
+// maxSeenBytes, advancing seenStartLine to match so Error's line numbers
+// stay correct relative to what's left. It only cuts at a newline, so a
+// single line longer than maxSeenBytes is left untouched rather than split.
+func (l *L) trimSeen() {
+	if len(l.seen) <= maxSeenBytes {
+		return
+	}
+	cut := bytes.IndexByte(l.seen[len(l.seen)-maxSeenBytes:], '\n')
+	if cut < 0 {
+		return
+	}
+	cut += len(l.seen) - maxSeenBytes + 1
+	l.seenStartLine += bytes.Count(l.seen[:cut], []byte("\n"))
+	l.seen = l.seen[cut:]
+}
+
+// emitEOF queues the single TokenEOF that follows the last real Token, if it
+// hasn't been queued already.
+func (l *L) emitEOF() {
+	if l.eofEmitted {
+		return
+	}
+	l.eofEmitted = true
+	l.items = append(l.items, Token{
+		Type:        TokenEOF,
+		Line:        l.line,
+		Col:         l.col,
+		StartOffset: l.offset,
+		EndOffset:   l.offset,
+	})
+}
+
+// run drives the Lexer to completion, queueing every Token it emits along
+// the way. Used by the deprecated Start/StartSync shims.
 func (l *L) run() {
-	state := l.startState
-	for state != nil {
-		state = state(l)
+	for l.state != nil {
+		l.state = l.state(l)
 	}
-	close(l.tokens)
+	l.emitEOF()
 }
@@ -0,0 +1,387 @@
+package lexer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// A minimal nested JSON-like grammar: an array of objects, each holding a
+// single string value, e.g. `[{"a"},{"b"}]`. lexObject uses PushState/
+// PopState to return to the enclosing array once its object closes, rather
+// than hard-coding lexArray as its own return value.
+const (
+	tokLBracket TokenType = iota
+	tokRBracket
+	tokLBrace
+	tokRBrace
+	tokString
+)
+
+func lexArray(l *L) StateFunc {
+	switch l.Peek() {
+	case EOFRune:
+		return nil
+	case '[':
+		l.Next()
+		l.Emit(tokLBracket)
+		return lexArray
+	case ']':
+		l.Next()
+		l.Emit(tokRBracket)
+		return l.PopState()
+	case '{':
+		l.PushState(lexArray)
+		l.Next()
+		l.Emit(tokLBrace)
+		return lexObject
+	default:
+		l.Next()
+		l.Ignore()
+		return lexArray
+	}
+}
+
+func lexObject(l *L) StateFunc {
+	switch l.Peek() {
+	case '}':
+		l.Next()
+		l.Emit(tokRBrace)
+		return l.PopState()
+	case '"':
+		l.Next()
+		l.Ignore()
+		for l.Peek() != '"' {
+			l.Next()
+		}
+		l.Emit(tokString)
+		l.Next()
+		l.Ignore()
+		return lexObject
+	default:
+		l.Next()
+		l.Ignore()
+		return lexObject
+	}
+}
+
+func TestAcceptHelpers(t *testing.T) {
+	l := New("123abc", nil)
+
+	if n := l.AcceptRun("0123456789"); n != 3 {
+		t.Fatalf("AcceptRun = %d, want 3", n)
+	}
+	if l.Current() != "123" {
+		t.Fatalf("Current = %q, want %q", l.Current(), "123")
+	}
+
+	if l.Accept("xyz") {
+		t.Fatal("Accept(\"xyz\") = true, want false")
+	}
+	if !l.Accept("abc") {
+		t.Fatal("Accept(\"abc\") = false, want true")
+	}
+
+	if got := l.PeekN(2); string(got) != "bc" {
+		t.Fatalf("PeekN(2) = %q, want %q", string(got), "bc")
+	}
+	if !l.AcceptString("bc") {
+		t.Fatal("AcceptString(\"bc\") = false, want true")
+	}
+	if l.AcceptString("xyz") {
+		t.Fatal("AcceptString(\"xyz\") = true, want false")
+	}
+	if l.Peek() != EOFRune {
+		t.Fatalf("Peek() = %q, want EOF", l.Peek())
+	}
+}
+
+func TestEmitRecordsStartPosition(t *testing.T) {
+	const tokWord TokenType = 0
+	l := New("foobar", func(l *L) StateFunc {
+		for i := 0; i < 3; i++ {
+			l.Next()
+		}
+		l.Emit(tokWord)
+		for i := 0; i < 3; i++ {
+			l.Next()
+		}
+		l.Emit(tokWord)
+		return nil
+	})
+
+	tok, _ := l.NextToken()
+	if tok.Value != "foo" || tok.Line != 1 || tok.Col != 1 || tok.StartOffset != 0 || tok.EndOffset != 3 {
+		t.Fatalf("first token = %+v, want foo at 1:1 [0:3]", tok)
+	}
+
+	// The second token's position is where "bar" starts, not where it ends -
+	// that's the bug this test guards against.
+	tok, _ = l.NextToken()
+	if tok.Value != "bar" || tok.Line != 1 || tok.Col != 4 || tok.StartOffset != 3 || tok.EndOffset != 6 {
+		t.Fatalf("second token = %+v, want bar at 1:4 [3:6]", tok)
+	}
+}
+
+func TestIgnoreAdvancesPosition(t *testing.T) {
+	const tokWord TokenType = 0
+	l := New("xxyy", func(l *L) StateFunc {
+		l.Next()
+		l.Next()
+		l.Ignore()
+		l.Next()
+		l.Next()
+		l.Emit(tokWord)
+		return nil
+	})
+
+	tok, _ := l.NextToken()
+	if tok.Line != 1 || tok.Col != 3 {
+		t.Fatalf("token = %+v, want 1:3", tok)
+	}
+}
+
+func TestIgnoreAdvancesLineAcrossNewline(t *testing.T) {
+	const tokWord TokenType = 0
+	l := New("\nbar", func(l *L) StateFunc {
+		l.Next()
+		l.Ignore()
+		for i := 0; i < 3; i++ {
+			l.Next()
+		}
+		l.Emit(tokWord)
+		return nil
+	})
+
+	tok, _ := l.NextToken()
+	if tok.Line != 2 || tok.Col != 1 {
+		t.Fatalf("token = %+v, want 2:1", tok)
+	}
+}
+
+func TestStartDrainsAllTokensUpFront(t *testing.T) {
+	const tokWord TokenType = 0
+	l := New("foo bar", func(l *L) StateFunc {
+		l.Take("foo")
+		l.Emit(tokWord)
+		l.Next()
+		l.Ignore()
+		l.Take("bar")
+		l.Emit(tokWord)
+		return nil
+	})
+	l.Start()
+
+	want := []string{"foo", "bar"}
+	for _, w := range want {
+		tok, done := l.NextToken()
+		if done || tok.Value != w {
+			t.Fatalf("token = %+v, done %v, want %q", tok, done, w)
+		}
+	}
+	if tok, done := l.NextToken(); done || tok.Type != TokenEOF {
+		t.Fatalf("token = %+v, done %v, want TokenEOF", tok, done)
+	}
+	if _, done := l.NextToken(); !done {
+		t.Fatal("NextToken after TokenEOF should report done")
+	}
+}
+
+func TestStartSyncDrainsAllTokensUpFront(t *testing.T) {
+	l := New("ab", func(l *L) StateFunc {
+		l.Next()
+		l.Emit(0)
+		l.Next()
+		l.Emit(0)
+		return nil
+	})
+	l.StartSync()
+
+	for _, want := range []string{"a", "b"} {
+		tok, done := l.NextToken()
+		if done || tok.Value != want {
+			t.Fatalf("token = %+v, done %v, want %q", tok, done, want)
+		}
+	}
+}
+
+func TestEmitStatePausesAndResumes(t *testing.T) {
+	const tokA, tokB TokenType = 0, 1
+	second := func(l *L) StateFunc {
+		l.Next()
+		return EmitState(tokB, nil)
+	}
+	l := New("ab", func(l *L) StateFunc {
+		l.Next()
+		return EmitState(tokA, second)
+	})
+
+	tok, done := l.NextToken()
+	if done || tok.Type != tokA || tok.Value != "a" {
+		t.Fatalf("first token = %+v, done %v", tok, done)
+	}
+
+	// If EmitState didn't pause after its single Emit and hand control back,
+	// second's own Emit would already be queued here too.
+	if n := len(l.items); n != 0 {
+		t.Fatalf("items after first NextToken = %d, want 0", n)
+	}
+
+	tok, done = l.NextToken()
+	if done || tok.Type != tokB || tok.Value != "b" {
+		t.Fatalf("second token = %+v, done %v", tok, done)
+	}
+}
+
+func TestNextTokenEmitsEOF(t *testing.T) {
+	l := New("a", func(l *L) StateFunc {
+		l.Next()
+		l.Emit(0)
+		return nil
+	})
+
+	tok, done := l.NextToken()
+	if done || tok.Type != 0 {
+		t.Fatalf("first token = %+v, done %v", tok, done)
+	}
+
+	tok, done = l.NextToken()
+	if done || tok.Type != TokenEOF {
+		t.Fatalf("second token = %+v, done %v, want TokenEOF", tok, done)
+	}
+
+	if _, done = l.NextToken(); !done {
+		t.Fatal("NextToken after TokenEOF should report done")
+	}
+}
+
+func TestErrorEmitsTokenError(t *testing.T) {
+	l := New("x", func(l *L) StateFunc {
+		l.Next()
+		l.Error(errors.New("boom"))
+		return nil
+	})
+
+	tok, done := l.NextToken()
+	if done {
+		t.Fatal("expected a TokenError before done")
+	}
+	if tok.Type != TokenError || tok.Value != "boom" {
+		t.Fatalf("token = %+v, want TokenError %q", tok, "boom")
+	}
+}
+
+func TestPushPopState(t *testing.T) {
+	l := New(`[{"a"},{"b"}]`, lexArray)
+	want := []TokenType{tokLBracket, tokLBrace, tokString, tokRBrace, tokLBrace, tokString, tokRBrace, tokRBracket, TokenEOF}
+	var got []TokenType
+	for {
+		tok, done := l.NextToken()
+		if done {
+			break
+		}
+		got = append(got, tok.Type)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d tokens %v, want %d %v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("token %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+// slowReader yields a single byte per Read, however large the buffer it's
+// given, to exercise NewReader against a source that arrives in chunks
+// smaller than a full rune.
+type slowReader struct {
+	data []byte
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestNewReaderSlowChunkedNonASCII(t *testing.T) {
+	const tokWord TokenType = 0
+	src := "héllo"
+	l := NewReader(&slowReader{data: []byte(src)}, func(l *L) StateFunc {
+		for l.Next() != EOFRune {
+		}
+		l.Emit(tokWord)
+		return nil
+	})
+
+	tok, _ := l.NextToken()
+	if tok.Value != src {
+		t.Fatalf("Value = %q, want %q", tok.Value, src)
+	}
+	if tok.StartOffset != 0 || tok.EndOffset != len(src) {
+		t.Fatalf("token = %+v, want StartOffset 0, EndOffset %d", tok, len(src))
+	}
+}
+
+func TestNextInvalidUTF8Offsets(t *testing.T) {
+	const tokAll TokenType = 0
+	src := []byte{'a', 0xFF, 'b'}
+	l := NewReader(bytes.NewReader(src), func(l *L) StateFunc {
+		for i := 0; i < len(src); i++ {
+			l.Next()
+		}
+		l.Emit(tokAll)
+		return nil
+	})
+
+	tok, _ := l.NextToken()
+	if tok.StartOffset != 0 || tok.EndOffset != len(src) {
+		t.Fatalf("token = %+v, want StartOffset 0, EndOffset %d", tok, len(src))
+	}
+}
+
+// erroringReader yields the bytes in data and then always fails with err.
+type erroringReader struct {
+	data []byte
+	err  error
+}
+
+func (r *erroringReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+	return 0, r.err
+}
+
+func TestNextSurfacesNonEOFError(t *testing.T) {
+	wantErr := errors.New("connection reset by peer")
+	l := NewReader(&erroringReader{data: []byte("a"), err: wantErr}, func(l *L) StateFunc {
+		for l.Next() != EOFRune {
+		}
+		return nil
+	})
+
+	var errTok *Token
+	for {
+		tok, done := l.NextToken()
+		if done {
+			break
+		}
+		if tok.Type == TokenError {
+			errTok = tok
+		}
+	}
+	if errTok == nil || errTok.Value != wantErr.Error() {
+		t.Fatalf("TokenError = %+v, want Value %q", errTok, wantErr.Error())
+	}
+	if l.Err == nil {
+		t.Fatal("Err = nil, want non-nil")
+	}
+}
@@ -0,0 +1,40 @@
+package lexer
+
+// runeStack is a simple stack of runes (and the number of source bytes each
+// one decoded from), used to support Rewind. Every rune read by Next is
+// pushed here so it can be popped back off, one at a time, up to the last
+// point a token was emitted or ignored.
+type runeStack struct {
+	runes []rune
+	sizes []int
+}
+
+// newRuneStack returns an empty runeStack ready to use.
+func newRuneStack() runeStack {
+	return runeStack{runes: make([]rune, 0, 10), sizes: make([]int, 0, 10)}
+}
+
+// push adds a rune and its byte size to the top of the stack.
+func (s *runeStack) push(v rune, size int) {
+	s.runes = append(s.runes, v)
+	s.sizes = append(s.sizes, size)
+}
+
+// pop removes and returns the rune and byte size at the top of the stack, or
+// EOFRune and 0 if the stack is empty.
+func (s *runeStack) pop() (rune, int) {
+	n := len(s.runes)
+	if n == 0 {
+		return EOFRune, 0
+	}
+	v, size := s.runes[n-1], s.sizes[n-1]
+	s.runes = s.runes[:n-1]
+	s.sizes = s.sizes[:n-1]
+	return v, size
+}
+
+// clear empties the stack.
+func (s *runeStack) clear() {
+	s.runes = s.runes[:0]
+	s.sizes = s.sizes[:0]
+}